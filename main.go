@@ -7,22 +7,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/nlopes/slack"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
 )
 
 type fInfo struct {
@@ -30,37 +37,102 @@ type fInfo struct {
 	sz      int64
 	mode    os.FileMode
 	modTime time.Time
+	algo    string
+}
+
+// fileRecord is the persisted, per-path baseline entry. It replaces the
+// bare checksum string so that the algorithm used to produce it travels
+// with the value - this matters once a tree can be hashed with more
+// than one algorithm.
+type fileRecord struct {
+	Algo     string    `json:"algo"`
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modtime"`
+	// FirstSeen is carried over from the prior baseline untouched; it is
+	// only set fresh the first time a path is seen.
+	FirstSeen time.Time `json:"first_seen"`
+	// LastVerified is bumped every run this path is confirmed present,
+	// whether that confirmation re-hashed it or took the mtime/size fast
+	// path - so operators can see how long a tampered file sat stable
+	// before its content changed.
+	LastVerified time.Time `json:"last_verified"`
+	// Errored marks a record carried forward (or stubbed) because the
+	// file could not be read this run. It is excluded from the
+	// changed/new bookkeeping and from missingPaths, so a transient read
+	// failure doesn't fabricate a deletion or a bogus diff.
+	Errored bool `json:"errored,omitempty"`
 }
 
 type item struct {
-	File     string
-	Checksum string
+	File   string
+	Record fileRecord
 }
 
 var conf struct {
-	Folders     []string `json:"folders"`
-	Storage     string   `json:"storage"`
-	Ignored     []string `json:"ignored"`
-	LogFile     string   `json:"logfile"`
-	SlackChatID string   `json:"slack_chat_id"`
-	SlackToken  string   `json:"slack_token"`
+	Folders     []string          `json:"folders"`
+	Storage     string            `json:"storage"`
+	Ignored     []string          `json:"ignored"`
+	LogFile     string            `json:"logfile"`
+	SlackChatID string            `json:"slack_chat_id"`
+	SlackToken  string            `json:"slack_token"`
+	DefaultAlgo string            `json:"default_algo"`
+	FolderAlgos map[string]string `json:"folder_algos"`
+	ChunkSize   int               `json:"chunk_size"`
+	Spool       string            `json:"spool"`
+	Notifiers   []NotifierConfig  `json:"notifiers"`
 }
 
-type checksumWorkerFunction func(int, string, *fInfo, error) string
+type checksumWorkerFunction func(int, string, *fInfo, error) (string, error)
+
+// CHUNKSIZE is the default read-buffer size handed to io.CopyBuffer. It
+// can be overridden per-install via conf.json's "chunk_size".
+const CHUNKSIZE uint64 = 128 * 1024
+const defaultAlgo = "sha1"
+
+// bufferSize is the size new pooled buffers are allocated at; it is set
+// from conf.ChunkSize (if given) before the workers are spawned.
+var bufferSize = int(CHUNKSIZE)
+
+// bufPool hands out read buffers to checksumWithAlgo so a busy tree
+// doesn't allocate (and immediately discard) one CHUNKSIZE buffer per
+// file.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, bufferSize)
+	},
+}
 
-const CHUNKSIZE uint64 = 8192
+// hashRegistry is the set of algorithms a folder (or the commandline)
+// may select by name. Adding a new algorithm is just adding an entry
+// here.
+var hashRegistry = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"xxh3":   func() hash.Hash { return xxh3.New() },
+}
 
 var wrkQueue = make(chan *fInfo)
 var outQueue = make(chan item)
 var globalL sync.Mutex
-var globalI map[string]string
-var globalO = map[string]string{}
+var globalI map[string]fileRecord
+var globalO = map[string]fileRecord{}
 var globalDiff []string
 var newfiles []string
 var ignored []string
 var currentRoot string
+var currentAlgo string
 var ferrors []string
+var errQueue = make(chan error)
 var wg sync.WaitGroup
+var force bool
+var paranoid bool
+var unchangedCount int
+var tamperCandidates []string
+var spoolDone = map[string]fileRecord{}
+var spoolFile *os.File
 
 func inSlice(words []string, word string) bool {
 	for _, w := range words {
@@ -71,46 +143,60 @@ func inSlice(words []string, word string) bool {
 	return false
 }
 
-func sendSlack(m string) {
-	if conf.SlackChatID != "" {
-		log.Printf("Sending slack message '%s'", m)
-		api := slack.New(conf.SlackToken)
-		api.PostMessage(
-			conf.SlackChatID,
-			slack.MsgOptionText(m, false),
-		)
+// resolveAlgo picks the algorithm for a given folder root: an explicit
+// per-folder pin in conf.json wins, otherwise the algorithm chosen on
+// the commandline, otherwise conf.json's default, otherwise sha1.
+func resolveAlgo(root, cliAlgo string) string {
+	if a, ok := conf.FolderAlgos[root]; ok && a != "" {
+		return a
+	}
+	if cliAlgo != "" {
+		return cliAlgo
 	}
+	if conf.DefaultAlgo != "" {
+		return conf.DefaultAlgo
+	}
+	return defaultAlgo
 }
 
-func checkSumSHA1(threadID int, pathname string, fi *fInfo, err error) string {
-	var filesize int64 = fi.sz
+// checksumWithAlgo looks up fi.algo in the hashRegistry and streams the
+// file through it, falling back to defaultAlgo for an unknown name so a
+// stale conf.json can't crash a running worker; the fallback is written
+// back to fi.algo so the stored record names the algorithm actually
+// used. Read errors (including
+// a short final read reported as io.ErrUnexpectedEOF) are returned to
+// the caller instead of being folded into the checksum string.
+func checksumWithAlgo(threadID int, pathname string, fi *fInfo, err error) (string, error) {
+	newHash, ok := hashRegistry[fi.algo]
+	if !ok {
+		fi.algo = defaultAlgo
+		newHash = hashRegistry[defaultAlgo]
+	}
 
 	file, err := os.Open(pathname)
 	if err != nil {
-		return fmt.Sprintf("%v", err)
+		return "", err
 	}
-
 	defer file.Close()
 
-	blocks := uint64(math.Ceil(float64(filesize) / float64(CHUNKSIZE)))
-
-	hash := sha1.New()
+	h := newHash()
 
-	for i := uint64(0); i < blocks; i++ {
-		blocksize := int(math.Min(float64(CHUNKSIZE), float64(filesize-int64(i*CHUNKSIZE))))
-		buf := make([]byte, blocksize)
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
 
-		file.Read(buf)
-		io.WriteString(hash, string(buf)) // 'tack on' the end
+	if _, err := io.CopyBuffer(h, file, buf); err != nil && err != io.EOF {
+		return "", err
 	}
 
-	return hex.EncodeToString(hash.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // This just 'walks' through the filesystem, grabbing fileInfo information; queueing up to the 'Work' input
 func walkPathNSum(pathname string, f os.FileInfo, err error) error {
 	if f == nil {
+		globalL.Lock()
 		ferrors = append(ferrors, fmt.Sprintf("can't read %s", pathname))
+		globalL.Unlock()
 		return nil
 	}
 	if inSlice(conf.Ignored, currentRoot+f.Name()) {
@@ -124,7 +210,37 @@ func walkPathNSum(pathname string, f os.FileInfo, err error) error {
 	if f.IsDir() {
 		return nil
 	}
-	i := &fInfo{name: pathname, sz: f.Size(), mode: f.Mode(), modTime: f.ModTime()}
+
+	// Incremental fast path: a file whose size and mtime match the prior
+	// baseline is assumed unchanged and copied through without re-hashing.
+	// --paranoid disables the short-circuit (it still hashes) so that a
+	// touched-but-not-modified mtime can't hide a real content change;
+	// --force disables it entirely. A prior record marked Errored (e.g. a
+	// stat-able file that failed os.Open) was not verified that run, and a
+	// stubbed one has no Checksum at all, so it's
+	// excluded here - taking the short-circuit would freeze it into the
+	// baseline unverified forever instead of retrying the hash.
+	if !force {
+		if prior, ok := globalI[pathname]; ok && !prior.Errored && prior.Size == f.Size() && prior.ModTime.Equal(f.ModTime()) {
+			if !paranoid {
+				rec := prior
+				rec.LastVerified = time.Now()
+				globalL.Lock()
+				globalO[pathname] = rec
+				unchangedCount++
+				globalL.Unlock()
+				return nil
+			}
+		}
+		if done, ok := spoolDone[pathname]; ok && !done.Errored && done.Size == f.Size() && done.ModTime.Equal(f.ModTime()) {
+			globalL.Lock()
+			globalO[pathname] = done
+			globalL.Unlock()
+			return nil
+		}
+	}
+
+	i := &fInfo{name: pathname, sz: f.Size(), mode: f.Mode(), modTime: f.ModTime(), algo: currentAlgo}
 	wrkQueue <- i
 	return nil
 }
@@ -132,7 +248,6 @@ func walkPathNSum(pathname string, f os.FileInfo, err error) error {
 // Worker function grabs a string from the input Q, uses the checksumWorkerFunction pointer to checksum the file and sends that to the putput Q
 func Worker(i int, inq chan *fInfo, outq chan item, cwf checksumWorkerFunction) {
 	var fileToCheck *fInfo
-	var err error
 
 	for {
 		fileToCheck = <-inq
@@ -140,12 +255,59 @@ func Worker(i int, inq chan *fInfo, outq chan item, cwf checksumWorkerFunction)
 			wg.Done()
 			break
 		}
-		outq <- item{File: fileToCheck.name, Checksum: cwf(i, fileToCheck.name, fileToCheck, err)}
+		sum, err := cwf(i, fileToCheck.name, fileToCheck, nil)
+		if err != nil {
+			errQueue <- fmt.Errorf("%s: %v", fileToCheck.name, err)
+			// Carry the prior record forward (or stub one) so a
+			// transient read failure doesn't erase the path from
+			// globalO and get mistaken for a deletion.
+			rec, ok := globalI[fileToCheck.name]
+			if !ok {
+				rec = fileRecord{Algo: fileToCheck.algo, Size: fileToCheck.sz, ModTime: fileToCheck.modTime}
+			}
+			rec.Errored = true
+			outq <- item{File: fileToCheck.name, Record: rec}
+			continue
+		}
+		now := time.Now()
+		firstSeen := now
+		if prior, ok := globalI[fileToCheck.name]; ok && !prior.FirstSeen.IsZero() {
+			firstSeen = prior.FirstSeen
+		}
+		rec := fileRecord{
+			Algo:         fileToCheck.algo,
+			Checksum:     sum,
+			Size:         fileToCheck.sz,
+			ModTime:      fileToCheck.modTime,
+			FirstSeen:    firstSeen,
+			LastVerified: now,
+		}
+		outq <- item{File: fileToCheck.name, Record: rec}
+	}
+}
+
+// ErrCollector drains errQueue into ferrors so read failures surfaced by
+// checksumWithAlgo still show up in the change report, instead of being
+// silently swallowed or smuggled into the checksum field. It closes
+// done once the nil sentinel has been drained.
+func ErrCollector(errq chan error, done chan struct{}) {
+	for {
+		e := <-errq
+		if e == nil {
+			break
+		}
+		globalL.Lock()
+		ferrors = append(ferrors, e.Error())
+		globalL.Unlock()
 	}
+	close(done)
 }
 
-// Outputter outputs the calculated checksum string to the appropriate entity (today, the console; tomorrow a DB)
-func Outputter(outq chan item) {
+// Outputter records each checksummed item in globalO (and the spool, if
+// one is configured), noting changed and new paths. It closes done once the
+// empty-File sentinel item has been drained, so callers can wait on
+// done instead of trusting a fixed sleep to mean "caught up".
+func Outputter(outq chan item, done chan struct{}) {
 	var out item
 
 	for {
@@ -154,20 +316,112 @@ func Outputter(outq chan item) {
 			break
 		}
 		globalL.Lock()
-		if v, ok := globalI[out.File]; ok {
-			if v != out.Checksum {
+		if out.Record.Errored {
+			// Keep the path present in globalO (carried-forward or
+			// stubbed record) without touching diff/new bookkeeping -
+			// a read failure is neither a change nor a deletion.
+			globalO[out.File] = out.Record
+			writeSpoolLine(out)
+			globalL.Unlock()
+			continue
+		}
+		// A prior stub (Errored with no Checksum) was never hashed, so
+		// this path counts as new rather than as changed.
+		if v, ok := globalI[out.File]; ok && !(v.Errored && v.Checksum == "") {
+			if v.Checksum != out.Record.Checksum {
 				globalDiff = append(globalDiff, out.File)
+				if v.Size == out.Record.Size && v.ModTime.Equal(out.Record.ModTime) {
+					// content changed under a stable size/mtime - only
+					// reachable under --paranoid or --force, or for a
+					// prior record marked Errored, since otherwise the
+					// fast path in walkPathNSum would have skipped it.
+					tamperCandidates = append(tamperCandidates, out.File)
+				}
 			}
 		} else {
 			newfiles = append(newfiles, out.File)
 		}
-		globalO[out.File] = out.Checksum
+		globalO[out.File] = out.Record
+		writeSpoolLine(out)
 		globalL.Unlock()
 		//		time.Sleep(time.Second * 1)
 	}
+	close(done)
+}
+
+// loadBaseline unmarshals the contents of conf.Storage into a baseline
+// map. Older baselines stored a bare map[string]string (path ->
+// checksum); those are migrated in-place to fileRecord entries tagged
+// with defaultAlgo so their checksums are still compared against. The
+// migrated entries carry no size or mtime, so the first run after an
+// upgrade re-hashes every known path.
+func loadBaseline(b []byte) map[string]fileRecord {
+	baseline := map[string]fileRecord{}
+	if err := json.Unmarshal(b, &baseline); err == nil {
+		return baseline
+	}
+
+	var legacy map[string]string
+	if err := json.Unmarshal(b, &legacy); err == nil {
+		for path, sum := range legacy {
+			baseline[path] = fileRecord{Algo: defaultAlgo, Checksum: sum}
+		}
+	}
+	return baseline
+}
+
+// loadSpool reads an append-only NDJSON spool file left behind by a
+// previous, interrupted run: one marshaled item per line. Paths it
+// contains are treated as already completed so a re-run of a large tree
+// doesn't redo finished work.
+func loadSpool(b []byte) map[string]fileRecord {
+	done := map[string]fileRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 1024*1024)
+	for scanner.Scan() {
+		var it item
+		if err := json.Unmarshal(scanner.Bytes(), &it); err == nil && it.File != "" {
+			done[it.File] = it.Record
+		}
+	}
+	return done
+}
+
+// missingPaths returns the paths present in the prior baseline but
+// absent from the one just produced - a silent deletion otherwise
+// invisible to the change report. A file that failed to hash this run
+// is carried into `current` as an Errored record rather than dropped
+// (see Worker/Outputter), so it is never mistaken here for a deletion.
+// Files under a directory that filepath.Walk could not read are not
+// carried forward, so they are listed here.
+func missingPaths(prior, current map[string]fileRecord) []string {
+	var missing []string
+	for p := range prior {
+		if _, ok := current[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// writeSpoolLine appends a completed item to the spool file, if one is
+// configured. Callers hold globalL, so lines never interleave.
+func writeSpoolLine(out item) {
+	if spoolFile == nil {
+		return
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	spoolFile.Write(b)
 }
 
 func main() {
+	startTime := time.Now()
 
 	if len(os.Args) < 2 {
 		fmt.Println("quick and dirty file integrity checker")
@@ -178,16 +432,43 @@ func main() {
 	byteValue, _ := ioutil.ReadFile(os.Args[1])
 	json.Unmarshal(byteValue, &conf)
 	byteValue, _ = ioutil.ReadFile(conf.Storage)
-	json.Unmarshal(byteValue, &globalI)
+	globalI = loadBaseline(byteValue)
+
+	if conf.ChunkSize > 0 {
+		bufferSize = conf.ChunkSize
+	}
 
 	//	var pause string
 	var numberCpus = runtime.NumCPU()
 
 	nPtr := flag.Int("cpuLimit", 0, "an int")
+	forcePtr := flag.Bool("force", false, "re-hash every file, ignoring the mtime/size fast path")
+	paranoidPtr := flag.Bool("paranoid", false, "hash every file even when mtime/size match the baseline, flagging any whose content changed anyway")
+	deletionThresholdPtr := flag.Float64("deletion-threshold", 0, "refuse to overwrite storage if more than N% of previously known paths are missing this run (0 disables the safety switch)")
 
 	// Assumes that the first argument is a FQDN, no '~' and uses '/'s vs. '\'s
 	flag.Parse()
 
+	force = *forcePtr
+	paranoid = *paranoidPtr
+
+	// second positional argument, e.g. the "sha1" in `ts8-mac . sha1 -cpuLimit=8`
+	var cliAlgo string
+	if len(flag.Args()) > 1 {
+		cliAlgo = flag.Args()[1]
+	}
+
+	if conf.Spool != "" {
+		spoolBytes, _ := ioutil.ReadFile(conf.Spool)
+		spoolDone = loadSpool(spoolBytes)
+		var spoolErr error
+		spoolFile, spoolErr = os.OpenFile(conf.Spool, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if spoolErr != nil {
+			log.Printf("could not open spool %s: %v", conf.Spool, spoolErr)
+			spoolFile = nil
+		}
+	}
+
 	if *nPtr > 0 {
 		runtime.GOMAXPROCS(*nPtr)
 		//		fmt.Println("\nWorker threads: changed from ", numberCpus, " to ", *nPtr)
@@ -200,10 +481,13 @@ func main() {
 	// spawn workers
 	for i := 0; i < *nPtr; i++ {
 		wg.Add(1)
-		go Worker(i, wrkQueue, outQueue, checkSumSHA1)
+		go Worker(i, wrkQueue, outQueue, checksumWithAlgo)
 	}
 
-	go Outputter(outQueue)
+	outDone := make(chan struct{})
+	errDone := make(chan struct{})
+	go Outputter(outQueue, outDone)
+	go ErrCollector(errQueue, errDone)
 
 	for _, root := range conf.Folders {
 		//fmt.Printf("walkin %s", root)
@@ -220,6 +504,7 @@ func main() {
 			root = target
 		}
 		currentRoot = root
+		currentAlgo = resolveAlgo(root, cliAlgo)
 		filepath.Walk(root, walkPathNSum)
 	}
 
@@ -227,24 +512,57 @@ func main() {
 		wrkQueue <- nil
 	}
 	wg.Wait()
-	time.Sleep(3 * time.Second) // outputter
-
+	// Every item a worker will ever send is already on outq by now
+	// (wg.Wait returned), so the empty-File sentinel is guaranteed to be
+	// the last thing Outputter sees; waiting on outDone means globalO is
+	// fully settled before it's read below, no fixed sleep required.
+	outQueue <- item{}
+	<-outDone
+	errQueue <- nil
+	<-errDone
+
+	globalL.Lock()
+	missing := missingPaths(globalI, globalO)
 	b, _ := json.Marshal(globalO)
+	globalL.Unlock()
 
-	ioutil.WriteFile(conf.Storage, b, 0644)
+	if *deletionThresholdPtr > 0 && len(globalI) > 0 && float64(len(missing))/float64(len(globalI))*100 > *deletionThresholdPtr {
+		ferrors = append(ferrors, fmt.Sprintf("refusing to overwrite %s: %d/%d known paths missing (> %.1f%% threshold)", conf.Storage, len(missing), len(globalI), *deletionThresholdPtr))
+	} else {
+		ioutil.WriteFile(conf.Storage, b, 0644)
+	}
 	//fmt.Printf("Written %s", conf.Storage)
-	if len(newfiles) > 0 || len(globalDiff) > 0 {
-		body := "On Rodial live we have modified/new files.\n"
-		if len(ferrors) > 0 {
-			fmt.Printf("Errors: %v\n", ferrors)
-		}
-		if len(globalDiff) > 0 {
-			body += fmt.Sprintf("Changed files/folders: %v\n", globalDiff)
-		}
-		if len(newfiles) > 0 {
-			body += fmt.Sprintf("New files/folders: %v\n", newfiles)
+
+	// The run finished, so the spool's job (surviving an interruption) is
+	// done; it is removed even when the deletion threshold kept
+	// conf.Storage from being overwritten above.
+	if spoolFile != nil {
+		spoolFile.Close()
+		os.Remove(conf.Spool)
+	}
+
+	reportAlgo := cliAlgo
+	if reportAlgo == "" {
+		reportAlgo = conf.DefaultAlgo
+	}
+	if reportAlgo == "" {
+		reportAlgo = defaultAlgo
+	}
+	hostname, _ := os.Hostname()
+	report := Report{
+		Hostname: hostname,
+		Duration: time.Since(startTime),
+		Algo:     reportAlgo,
+		Changed:  globalDiff,
+		New:      newfiles,
+		Missing:  missing,
+		Errors:   ferrors,
+		Digest:   digest(globalO),
+	}
+	for _, n := range buildNotifiers() {
+		if err := n.Notify(context.Background(), report); err != nil {
+			log.Printf("notifier error: %v", err)
 		}
-		sendSlack(body)
 	}
 	f, err := os.OpenFile(conf.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
@@ -262,4 +580,12 @@ func main() {
 	if len(newfiles) > 0 {
 		log.Printf("New files/folders: %v", newfiles)
 	}
+	if len(missing) > 0 {
+		log.Printf("Missing files/folders: %v", missing)
+	}
+	if len(tamperCandidates) > 0 {
+		log.Printf("Tamper candidates (stable mtime, changed content): %v", tamperCandidates)
+	}
+	log.Printf("Unchanged (skipped via fast path): %d", unchangedCount)
+	log.Printf("Digest: %s", report.Digest)
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Report is the outcome of one scan, handed to every configured
+// Notifier. It carries enough to render a human message (Slack, email,
+// log line) or let a management system like BigFix/Casper attest to the
+// whole tree via Digest alone.
+type Report struct {
+	Hostname string
+	Duration time.Duration
+	Algo     string
+	Changed  []string
+	New      []string
+	Missing  []string
+	Errors   []string
+	Digest   string
+}
+
+// Severity gates which reports a Notifier is woken up for.
+type Severity string
+
+const (
+	// SeverityAny delivers every report, clean or not. Mostly useful
+	// for a heartbeat-style notifier that a monitoring system expects
+	// to hear from on every run.
+	SeverityAny Severity = "any"
+	// SeverityActivity delivers reports with new, changed, or missing
+	// paths - this is the old hard-coded Slack trigger
+	// (len(newfiles)>0 || len(globalDiff)>0), extended to also cover
+	// deletions now that missingPaths exists.
+	SeverityActivity Severity = "activity"
+	// SeverityChanged only delivers reports where something actually
+	// changed or went missing - new-only runs are suppressed.
+	SeverityChanged Severity = "changed"
+)
+
+// meets reports whether this report clears a notifier's configured
+// threshold. An empty threshold behaves like SeverityAny, so an
+// explicitly configured notifier that doesn't set "severity" keeps
+// hearing about every run.
+func (r Report) meets(want Severity) bool {
+	switch want {
+	case SeverityChanged:
+		return len(r.Changed) > 0 || len(r.Missing) > 0
+	case SeverityActivity:
+		return len(r.Changed) > 0 || len(r.Missing) > 0 || len(r.New) > 0
+	default:
+		return true
+	}
+}
+
+func (r Report) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s finished a %s scan in %s\n", r.Hostname, r.Algo, r.Duration)
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(&b, "Errors: %v\n", r.Errors)
+	}
+	if len(r.Changed) > 0 {
+		fmt.Fprintf(&b, "Changed files/folders: %v\n", r.Changed)
+	}
+	if len(r.New) > 0 {
+		fmt.Fprintf(&b, "New files/folders: %v\n", r.New)
+	}
+	if len(r.Missing) > 0 {
+		fmt.Fprintf(&b, "Missing files/folders: %v\n", r.Missing)
+	}
+	fmt.Fprintf(&b, "Digest: %s\n", r.Digest)
+	return b.String()
+}
+
+// Notifier delivers a Report somewhere outside the process. Ship new
+// backends by implementing this and adding a case to buildNotifiers.
+type Notifier interface {
+	Notify(ctx context.Context, r Report) error
+}
+
+// NotifierConfig is one entry of conf.json's "notifiers" list. Only the
+// fields relevant to Type are read.
+type NotifierConfig struct {
+	Type     string   `json:"type"`
+	Severity string   `json:"severity"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	SMTPHost string   `json:"smtp_host"`
+	SMTPPort int      `json:"smtp_port"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Path     string   `json:"path"`
+}
+
+type slackNotifier struct {
+	chatID string
+	token  string
+	min    Severity
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, r Report) error {
+	if n.chatID == "" || !r.meets(n.min) {
+		return nil
+	}
+	api := slack.New(n.token)
+	_, _, err := api.PostMessage(n.chatID, slack.MsgOptionText(r.summary(), false))
+	return err
+}
+
+// webhookNotifier POSTs the Report as JSON, signing the body with HMAC-
+// SHA256 (shared secret) so the receiving end can verify it came from
+// us.
+type webhookNotifier struct {
+	url    string
+	secret string
+	min    Severity
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, r Report) error {
+	if !r.meets(n.min) {
+		return nil
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	host string
+	port int
+	from string
+	to   []string
+	min  Severity
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, r Report) error {
+	if !r.meets(n.min) {
+		return nil
+	}
+	addr := fmt.Sprintf("%s:%d", n.host, n.port)
+	msg := fmt.Sprintf("Subject: fim report for %s\r\n\r\n%s", r.Hostname, r.summary())
+	return smtp.SendMail(addr, nil, n.from, n.to, []byte(msg))
+}
+
+type fileNotifier struct {
+	path string
+	min  Severity
+}
+
+func (n *fileNotifier) Notify(ctx context.Context, r Report) error {
+	if !r.meets(n.min) {
+		return nil
+	}
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(r.summary())
+	return err
+}
+
+// buildNotifiers turns conf.Notifiers into live Notifier values. If
+// none are configured but the legacy slack_chat_id/slack_token fields
+// are set, a single Slack notifier is synthesized so existing conf.json
+// files keep working unchanged - at SeverityActivity, matching the old
+// hard-coded behavior of only posting when something was new or
+// changed instead of on every clean run.
+func buildNotifiers() []Notifier {
+	var notifiers []Notifier
+	for _, nc := range conf.Notifiers {
+		min := Severity(nc.Severity)
+		switch nc.Type {
+		case "slack":
+			notifiers = append(notifiers, &slackNotifier{chatID: conf.SlackChatID, token: conf.SlackToken, min: min})
+		case "webhook":
+			notifiers = append(notifiers, &webhookNotifier{url: nc.URL, secret: nc.Secret, min: min})
+		case "smtp":
+			notifiers = append(notifiers, &smtpNotifier{host: nc.SMTPHost, port: nc.SMTPPort, from: nc.From, to: nc.To, min: min})
+		case "file":
+			notifiers = append(notifiers, &fileNotifier{path: nc.Path, min: min})
+		}
+	}
+	if len(notifiers) == 0 && conf.SlackChatID != "" {
+		notifiers = append(notifiers, &slackNotifier{chatID: conf.SlackChatID, token: conf.SlackToken, min: SeverityActivity})
+	}
+	return notifiers
+}
+
+// digest computes a Merkle-style root hash over the sorted {path,
+// checksum} pairs of a baseline, so a management system can attest to
+// the whole tree's state with one value instead of parsing the change
+// list.
+func digest(files map[string]fileRecord) string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s:%s\n", p, files[p].Checksum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}